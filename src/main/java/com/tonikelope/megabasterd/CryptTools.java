@@ -23,6 +23,7 @@ import java.nio.ByteBuffer;
 import java.security.InvalidAlgorithmParameterException;
 import java.security.InvalidKeyException;
 import java.security.KeyFactory;
+import java.security.MessageDigest;
 import java.security.NoSuchAlgorithmException;
 import java.security.interfaces.RSAPrivateKey;
 import java.security.spec.InvalidKeySpecException;
@@ -38,6 +39,7 @@ import java.util.zip.GZIPInputStream;
 import javax.crypto.BadPaddingException;
 import javax.crypto.Cipher;
 import javax.crypto.IllegalBlockSizeException;
+import javax.crypto.Mac;
 import javax.crypto.NoSuchPaddingException;
 import javax.crypto.SecretKeyFactory;
 import javax.crypto.spec.IvParameterSpec;
@@ -60,6 +62,12 @@ public class CryptTools {
     public static final int MASTER_PASSWORD_PBKDF2_OUTPUT_BIT_LENGTH = 256;
 
     public static final int MASTER_PASSWORD_PBKDF2_ITERATIONS = 65536;
+
+    public static final int PASSWORD_LINK_PBKDF2_ITERATIONS = 100000;
+
+    public static final int PASSWORD_LINK_PBKDF2_OUTPUT_BIT_LENGTH = 512;
+
+    public static final int MEGA_FILE_KEY_LENGTH = 32;
     private static final Logger LOG = Logger.getLogger(CryptTools.class.getName());
 
     public static Cipher genDecrypter(String algo, String mode, byte[] key, byte[] iv) throws NoSuchAlgorithmException, NoSuchPaddingException, InvalidKeyException, InvalidAlgorithmParameterException {
@@ -209,6 +217,19 @@ public class CryptTools {
         return plainText;
     }
 
+    //Decoded length of a MEGA file key (or -1 if it is missing or not valid base64)
+    public static int getMEGAFileKeyLength(String key_string) {
+
+        try {
+
+            return key_string != null ? UrlBASE642Bin(key_string).length : -1;
+
+        } catch (IllegalArgumentException ex) {
+
+            return -1;
+        }
+    }
+
     public static byte[] initMEGALinkKey(String key_string) {
         int[] int_key = bin2i32a(UrlBASE642Bin(key_string));
         int[] k = new int[4];
@@ -280,6 +301,60 @@ public class CryptTools {
         }
     }
 
+    /*
+    MEGA password protected link (#P!) layout:
+    algorithm (1) | type (1, 0=folder 1=file) | handle (6) | salt (32) | encrypted key (16 folder, 32 file) | HMAC-SHA256 (32)
+
+    Returns the ordinary MEGA link or null if the password is wrong.
+     */
+    public static String decryptMegaPasswordLink(String link, String password) throws Exception {
+
+        byte[] data = UrlBASE642Bin(findFirstRegex("#P!([A-Za-z0-9_-]+)", link, 1));
+
+        if (data.length < 2) {
+            throw new Exception("Bad MEGA password link");
+        }
+
+        int algorithm = data[0] & 0xFF;
+
+        int type = data[1] & 0xFF;
+
+        int key_length = (type == 0) ? 16 : 32;
+
+        if ((algorithm != 1 && algorithm != 2) || type > 1 || data.length != 40 + key_length + 32) {
+            throw new Exception("Bad MEGA password link");
+        }
+
+        byte[] handle = Arrays.copyOfRange(data, 2, 8);
+
+        byte[] salt = Arrays.copyOfRange(data, 8, 40);
+
+        byte[] enc_key = Arrays.copyOfRange(data, 40, 40 + key_length);
+
+        byte[] link_mac = Arrays.copyOfRange(data, 40 + key_length, data.length);
+
+        byte[] derived_key = PBKDF2HMACSHA512(password, salt, PASSWORD_LINK_PBKDF2_ITERATIONS, PASSWORD_LINK_PBKDF2_OUTPUT_BIT_LENGTH);
+
+        byte[] mac_key = Arrays.copyOfRange(derived_key, 32, 64);
+
+        byte[] mac_data = Arrays.copyOfRange(data, 0, 40 + key_length);
+
+        //Algorithm 1 (legacy) swapped HMAC key and message
+        byte[] mac = (algorithm == 1) ? HMACSHA256(mac_key, mac_data) : HMACSHA256(mac_data, mac_key);
+
+        if (!MessageDigest.isEqual(mac, link_mac)) {
+            return null;
+        }
+
+        byte[] key = new byte[key_length];
+
+        for (int i = 0; i < key_length; i++) {
+            key[i] = (byte) (enc_key[i] ^ derived_key[i]);
+        }
+
+        return "https://mega.nz/#" + (type == 0 ? "F" : "") + "!" + Bin2UrlBASE64(handle) + "!" + Bin2UrlBASE64(key);
+    }
+
     public static HashSet<String> decryptELC(String link, MainPanel main_panel) {
 
         String elc;
@@ -666,6 +741,15 @@ public class CryptTools {
         return f.generateSecret(ks).getEncoded();
     }
 
+    public static byte[] HMACSHA256(byte[] data, byte[] key) throws NoSuchAlgorithmException, InvalidKeyException {
+
+        Mac mac = Mac.getInstance("HmacSHA256");
+
+        mac.init(new SecretKeySpec(key, "HmacSHA256"));
+
+        return mac.doFinal(data);
+    }
+
     private CryptTools() {
     }
 }
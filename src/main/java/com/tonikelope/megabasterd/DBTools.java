@@ -232,6 +232,26 @@ public class DBTools {
         }
     }
 
+    public static synchronized String selectDownloadUrl(String path, String filename) throws SQLException {
+
+        String url = null;
+
+        try (Connection conn = SqliteSingleton.getInstance().getConn(); PreparedStatement ps = conn.prepareStatement("SELECT url FROM downloads WHERE path=? AND filename=?")) {
+
+            ps.setString(1, path);
+
+            ps.setString(2, filename);
+
+            ResultSet res = ps.executeQuery();
+
+            if (res.next()) {
+                url = res.getString(1);
+            }
+        }
+
+        return url;
+    }
+
     public static synchronized void insertUpload(String filename, String email, String parent_node, String ul_key, String root_node, String share_key, String folder_link) throws SQLException {
 
         try (Connection conn = SqliteSingleton.getInstance().getConn(); PreparedStatement ps = conn.prepareStatement("INSERT INTO uploads (filename, email, parent_node, ul_key, root_node, share_key, folder_link, bytes_uploaded, meta_mac) VALUES (?,?,?,?,?,?,?,?,?)")) {
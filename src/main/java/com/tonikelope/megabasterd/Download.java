@@ -14,10 +14,8 @@ import static com.tonikelope.megabasterd.DBTools.*;
 import static com.tonikelope.megabasterd.MainPanel.*;
 import static com.tonikelope.megabasterd.MiscTools.*;
 import java.awt.Color;
-import java.io.BufferedInputStream;
 import java.io.BufferedOutputStream;
 import java.io.File;
-import java.io.FileInputStream;
 import java.io.FileNotFoundException;
 import java.io.FileOutputStream;
 import java.io.IOException;
@@ -25,11 +23,13 @@ import java.io.OutputStream;
 import static java.lang.Integer.MAX_VALUE;
 import static java.lang.Long.valueOf;
 import static java.lang.Thread.sleep;
+import java.nio.ByteBuffer;
 import java.nio.channels.FileChannel;
 import java.nio.file.FileStore;
 import java.nio.file.Files;
 import java.nio.file.Paths;
 import java.nio.file.StandardCopyOption;
+import java.nio.file.StandardOpenOption;
 import java.security.InvalidAlgorithmParameterException;
 import java.security.InvalidKeyException;
 import java.security.NoSuchAlgorithmException;
@@ -38,8 +38,12 @@ import java.util.ArrayList;
 import java.util.Arrays;
 import java.util.concurrent.ConcurrentLinkedQueue;
 import java.util.concurrent.ExecutorService;
+import java.util.concurrent.Executors;
+import java.util.concurrent.Future;
 import static java.util.concurrent.Executors.newCachedThreadPool;
 import java.util.concurrent.TimeUnit;
+import java.util.concurrent.atomic.AtomicLong;
+import java.util.concurrent.atomic.AtomicReference;
 import java.util.logging.Level;
 import static java.util.logging.Level.SEVERE;
 import java.util.logging.Logger;
@@ -57,10 +61,12 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
 
     public static final boolean VERIFY_CBC_MAC_DEFAULT = false;
     public static final boolean USE_SLOTS_DEFAULT = true;
-    public static final int WORKERS_DEFAULT = 6;
+    public static final int WORKERS_DEFAULT = Math.max(4, Math.min(16, Runtime.getRuntime().availableProcessors()));
     public static final boolean USE_MEGA_ACCOUNT_DOWN = false;
     public static final boolean DEFAULT_CLIPBOARD_LINK_MONITOR = true;
     public static final int CHUNK_SIZE_MULTI = 20;
+    public static final int MAX_FILENAME_CONFLICTS = 5;
+    public static final int CBC_VERIFY_CHUNKS_PER_WORKER = 32;
     private static final Logger LOG = Logger.getLogger(Download.class.getName());
 
     private final MainPanel _main_panel;
@@ -237,7 +243,7 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
 
     public long calculateLastWrittenChunk(long temp_file_size) {
         if (temp_file_size > 3584 * 1024) {
-            return 7 + (long) Math.floor((float) (temp_file_size - 3584 * 1024) / (1024 * 1024 * (this.isUse_slots() ? Download.CHUNK_SIZE_MULTI : 1)));
+            return 7 + (temp_file_size - 3584 * 1024) / (1024L * 1024 * (this.isUse_slots() ? Download.CHUNK_SIZE_MULTI : 1));
         } else {
             long i = 0, tot = 0;
 
@@ -599,7 +605,7 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
                 if (!_file.exists() || _file.length() != _file_size) {
 
                     if (_file.exists()) {
-                        _file_name = _file_name.replaceFirst("\\..*$", "_" + MiscTools.genID(8) + "_$0");
+                        _file_name = _genUniqueFileName(_file_name);
 
                         filename = _download_path + "/" + _file_name;
 
@@ -1013,6 +1019,78 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
         LOG.log(Level.INFO, "{0}{1} Downloader: bye bye", new Object[]{Thread.currentThread().getName(), _file_name});
     }
 
+    private String _genUniqueFileName(String file_name) {
+
+        String id = MiscTools.genID(8);
+
+        //Folder downloads carry a relative path, so only the last component is renamed
+        int sep = Math.max(file_name.lastIndexOf('/'), file_name.lastIndexOf('\\'));
+
+        String dir = file_name.substring(0, sep + 1);
+
+        String name = file_name.substring(sep + 1);
+
+        return dir + (name.contains(".") ? name.replaceFirst("\\..*$", "_" + id + "_$0") : name + "_" + id);
+    }
+
+    //The UNIQUE(path, filename) constraint claims the name atomically. If another download got it first, we pick a new name and try again.
+    private void _insertDownloadAvoidingCollisions(boolean allow_rename) throws SQLException {
+
+        int conflicts = 0;
+
+        String orig_file_name = _file_name;
+
+        while (true) {
+
+            try {
+
+                insertDownload(_url, _ma.getFull_email(), _download_path, _file_name, _file_key, _file_size, _file_pass, _file_noexpire, _custom_chunks_dir);
+
+                return;
+
+            } catch (SQLException ex) {
+
+                String conflict_url = allow_rename ? selectDownloadUrl(_download_path, _file_name) : null;
+
+                //Same url means this download is already registered, that is not a name collision
+                if (conflict_url == null || conflict_url.equals(_url) || conflicts >= MAX_FILENAME_CONFLICTS) {
+
+                    _file_name = orig_file_name;
+
+                    throw ex;
+                }
+
+                conflicts++;
+
+                String old_file_name = _file_name;
+
+                _file_name = _genUniqueFileName(old_file_name);
+
+                LOG.log(Level.WARNING, "{0} Filename collision {1} -> {2}", new Object[]{Thread.currentThread().getName(), old_file_name, _file_name});
+            }
+        }
+    }
+
+    //Checks the final folder and the one that will hold the .mctemp file (they differ when custom chunks dir is set)
+    private String _findUnwritableDownloadDir() {
+
+        for (String dir_path : new String[]{_download_path, getCustom_chunks_dir()}) {
+
+            if (dir_path != null) {
+
+                File dir = new File(dir_path);
+
+                dir.mkdirs();
+
+                if (!dir.isDirectory() || !Files.isWritable(dir.toPath())) {
+                    return dir_path;
+                }
+            }
+        }
+
+        return null;
+    }
+
     public void provisionIt(boolean retry) throws APIException {
 
         getView().printStatusNormal("Provisioning download, please wait...");
@@ -1027,7 +1105,14 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
         _provision_ok = false;
 
         try {
-            if (_file_name == null) {
+
+            String bad_dir = _findUnwritableDownloadDir();
+
+            if (bad_dir != null) {
+
+                _status_error = "DOWNLOAD FOLDER COULD NOT BE CREATED OR IS NOT WRITABLE! (" + bad_dir + ")";
+
+            } else if (_file_name == null) {
 
                 //New single file links
                 file_info = getMegaFileMetadata(_url, getMain_panel().getView(), retry);
@@ -1052,12 +1137,12 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
                     File file = new File(filename);
 
                     if (file.exists() && file.length() != _file_size) {
-                        _file_name = _file_name.replaceFirst("\\..*$", "_" + MiscTools.genID(8) + "_$0");
+                        _file_name = _genUniqueFileName(_file_name);
                     }
 
                     try {
 
-                        insertDownload(_url, _ma.getFull_email(), _download_path, _file_name, _file_key, _file_size, _file_pass, _file_noexpire, _custom_chunks_dir);
+                        _insertDownloadAvoidingCollisions(true);
 
                         _provision_ok = true;
 
@@ -1076,7 +1161,7 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
                 File temp_file = new File(filename + ".mctemp");
 
                 if (file.exists() && !temp_file.exists() && file.length() != _file_size) {
-                    _file_name = _file_name.replaceFirst("\\..*$", "_" + MiscTools.genID(8) + "_$0");
+                    _file_name = _genUniqueFileName(_file_name);
                 }
 
                 //Resuming single file links and new/resuming folder links
@@ -1084,7 +1169,7 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
 
                     deleteDownload(_url); //If resuming
 
-                    insertDownload(_url, _ma.getFull_email(), _download_path, _file_name, _file_key, _file_size, _file_pass, _file_noexpire, _custom_chunks_dir);
+                    _insertDownloadAvoidingCollisions(!temp_file.exists());
 
                     _provision_ok = true;
 
@@ -1349,9 +1434,31 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
 
     }
 
-    private boolean verifyFileCBCMAC(String filename) throws FileNotFoundException, Exception, NoSuchAlgorithmException, NoSuchPaddingException, InvalidKeyException, InvalidAlgorithmParameterException, IllegalBlockSizeException, BadPaddingException {
+    private int[] _calculateChunkCBCMAC(FileChannel channel, long chunk_offset, long chunk_size, byte[] byte_file_key, int[] iv) throws Exception {
+
+        int[] chunk_mac = {iv[0], iv[1], iv[0], iv[1]};
+
+        if (chunk_size == 0) {
+            return chunk_mac;
+        }
 
-        int old_thread_priority = Thread.currentThread().getPriority();
+        //Zero padded to the AES block size
+        ByteBuffer chunk_data = ByteBuffer.allocate((int) (16 * Math.ceil((double) chunk_size / 16)));
+
+        chunk_data.limit((int) chunk_size);
+
+        while (chunk_data.hasRemaining() && channel.read(chunk_data, chunk_offset + chunk_data.position()) != -1) {
+        }
+
+        //The chunk MAC is the last block of the AES-CBC encrypted chunk using the chunk MAC IV
+        Cipher cryptor = genCrypter("AES", "AES/CBC/NoPadding", byte_file_key, i32a2bin(chunk_mac));
+
+        byte[] enc_chunk = cryptor.doFinal(chunk_data.array());
+
+        return bin2i32a(Arrays.copyOfRange(enc_chunk, enc_chunk.length - 16, enc_chunk.length));
+    }
+
+    private boolean verifyFileCBCMAC(String filename) throws FileNotFoundException, Exception, NoSuchAlgorithmException, NoSuchPaddingException, InvalidKeyException, InvalidAlgorithmParameterException, IllegalBlockSizeException, BadPaddingException {
 
         int[] int_key = bin2i32a(UrlBASE642Bin(_file_key));
         int[] iv = new int[]{int_key[4], int_key[5]};
@@ -1361,75 +1468,112 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
 
         byte[] byte_file_key = initMEGALinkKey(getFile_key());
 
+        long chunk_count = 0L;
+
+        try {
+            while (true) {
+
+                ChunkWriterManager.checkChunkID(chunk_count + 1, getFile_size(), ChunkWriterManager.calculateChunkOffset(chunk_count + 1, 1));
+
+                chunk_count++;
+            }
+
+        } catch (ChunkInvalidException e) {
+
+        }
+
+        final long total_chunks = chunk_count;
+
+        int verify_workers = (int) Math.max(1, Math.min(Runtime.getRuntime().availableProcessors(), total_chunks));
+
+        //Chunk MACs are independent from each other so we calculate them in parallel, but only one window of them is kept in memory before condensing them (in order)
+        int window_size = verify_workers * CBC_VERIFY_CHUNKS_PER_WORKER;
+
+        int[][] chunk_macs = new int[window_size][];
+
+        AtomicLong verified_bytes = new AtomicLong(0L);
+
+        AtomicReference<Exception> worker_error = new AtomicReference<>();
+
         Cipher cryptor = genCrypter("AES", "AES/CBC/NoPadding", byte_file_key, i32a2bin(cbc_iv));
 
-        try (BufferedInputStream is = new BufferedInputStream(new FileInputStream(filename))) {
+        ExecutorService executor = Executors.newFixedThreadPool(verify_workers);
 
-            long chunk_id = 1L;
-            long tot = 0L;
-            byte[] byte_block = new byte[16];
-            int[] int_block;
-            int reads;
-            int[] chunk_mac = new int[4];
+        try {
 
-            try {
-                while (!_exit) {
+            for (long window_start = 1L; window_start <= total_chunks; window_start += window_size) {
 
-                    long chunk_offset = ChunkWriterManager.calculateChunkOffset(chunk_id, 1);
+                final long first_chunk_id = window_start;
 
-                    long chunk_size = ChunkWriterManager.calculateChunkSize(chunk_id, this.getFile_size(), chunk_offset, 1);
+                final long last_chunk_id = Math.min(total_chunks, window_start + window_size - 1);
 
-                    ChunkWriterManager.checkChunkID(chunk_id, this.getFile_size(), chunk_offset);
+                AtomicLong next_chunk_id = new AtomicLong(first_chunk_id);
 
-                    tot += chunk_size;
+                ArrayList<Future<?>> futures = new ArrayList<>();
 
-                    chunk_mac[0] = iv[0];
-                    chunk_mac[1] = iv[1];
-                    chunk_mac[2] = iv[0];
-                    chunk_mac[3] = iv[1];
+                for (int w = 0; w < verify_workers; w++) {
 
-                    long conta_chunk = 0L;
+                    futures.add(executor.submit(() -> {
 
-                    while (conta_chunk < chunk_size && (reads = is.read(byte_block)) != -1) {
+                        try (FileChannel channel = FileChannel.open(Paths.get(filename), StandardOpenOption.READ)) {
 
-                        if (reads < byte_block.length) {
+                            long chunk_id;
 
-                            for (int i = reads; i < byte_block.length; i++) {
-                                byte_block[i] = 0;
-                            }
-                        }
+                            while (!_exit && worker_error.get() == null && (chunk_id = next_chunk_id.getAndIncrement()) <= last_chunk_id) {
 
-                        int_block = bin2i32a(byte_block);
+                                long chunk_offset = ChunkWriterManager.calculateChunkOffset(chunk_id, 1);
 
-                        for (int i = 0; i < chunk_mac.length; i++) {
-                            chunk_mac[i] ^= int_block[i];
-                        }
+                                long chunk_size = ChunkWriterManager.calculateChunkSize(chunk_id, getFile_size(), chunk_offset, 1);
 
-                        chunk_mac = bin2i32a(cryptor.doFinal(i32a2bin(chunk_mac)));
+                                chunk_macs[(int) (chunk_id - first_chunk_id)] = _calculateChunkCBCMAC(channel, chunk_offset, chunk_size, byte_file_key, iv);
 
-                        conta_chunk += reads;
-                    }
+                                verified_bytes.addAndGet(chunk_size);
+                            }
 
-                    for (int i = 0; i < file_mac.length; i++) {
-                        file_mac[i] ^= chunk_mac[i];
-                    }
+                        } catch (Exception ex) {
 
-                    file_mac = bin2i32a(cryptor.doFinal(i32a2bin(file_mac)));
+                            //The other workers stop as soon as one of them fails
+                            worker_error.compareAndSet(null, ex);
+                        }
+                    }));
+                }
 
-                    setProgress(tot);
+                for (Future<?> future : futures) {
+                    future.get();
+                }
 
-                    chunk_id++;
+                if (worker_error.get() != null) {
+                    throw worker_error.get();
+                }
 
+                if (_exit) {
+                    return false;
                 }
 
-            } catch (ChunkInvalidException e) {
+                setProgress(verified_bytes.get());
+
+                for (int i = 0; i <= last_chunk_id - first_chunk_id; i++) {
+
+                    for (int j = 0; j < file_mac.length; j++) {
+                        file_mac[j] ^= chunk_macs[i][j];
+                    }
 
+                    file_mac = bin2i32a(cryptor.doFinal(i32a2bin(file_mac)));
+                }
             }
 
-            int[] cbc = {file_mac[0] ^ file_mac[1], file_mac[2] ^ file_mac[3]};
+        } finally {
 
-            return (cbc[0] == meta_mac[0] && cbc[1] == meta_mac[1]);
+            executor.shutdownNow();
         }
+
+        if (_exit) {
+            return false;
+        }
+
+        int[] cbc = {file_mac[0] ^ file_mac[1], file_mac[2] ^ file_mac[3]};
+
+        return (cbc[0] == meta_mac[0] && cbc[1] == meta_mac[1]);
     }
 
     public void stopDownloader() {
@@ -1516,13 +1660,15 @@ public class Download implements Transference, Runnable, SecureSingleThreadNotif
 
                 if (error_code == -16) {
                     _status_error = "ERROR: MEGA FILE BLOCKED/DELETED";
+                } else if (error_code == -14) {
+                    _status_error = "ERROR: MEGA FILE KEY IS NOT VALID";
                 }
 
                 if (Arrays.asList(FATAL_API_ERROR_CODES).contains(error_code)) {
 
                     _auto_retry_on_error = Arrays.asList(FATAL_API_ERROR_CODES_WITH_RETRY).contains(error_code);
 
-                    stopDownloader(error_code == -16 ? _status_error : ex.getMessage() + " " + truncateText(link, 80));
+                    stopDownloader((error_code == -16 || error_code == -14) ? _status_error : ex.getMessage() + " " + truncateText(link, 80));
 
                 } else {
 
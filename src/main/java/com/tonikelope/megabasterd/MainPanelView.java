@@ -52,6 +52,7 @@ import static javax.swing.JOptionPane.QUESTION_MESSAGE;
 import static javax.swing.JOptionPane.YES_NO_CANCEL_OPTION;
 import static javax.swing.JOptionPane.showOptionDialog;
 import javax.swing.JPanel;
+import javax.swing.JPasswordField;
 import javax.swing.JProgressBar;
 import javax.swing.JTabbedPane;
 
@@ -407,6 +408,41 @@ public final class MainPanelView extends javax.swing.JFrame {
 
     }
 
+    private String _decryptMegaPasswordLink(String link) {
+
+        JPasswordField pass_field = new JPasswordField();
+
+        while (true) {
+
+            pass_field.setText("");
+
+            int res = JOptionPane.showConfirmDialog(this, new Object[]{LabelTranslatorSingleton.getInstance().translate("This link is password protected:") + "\n" + link, pass_field}, LabelTranslatorSingleton.getInstance().translate("Password protected link"), JOptionPane.OK_CANCEL_OPTION, QUESTION_MESSAGE);
+
+            if (res != JOptionPane.OK_OPTION) {
+                return null;
+            }
+
+            try {
+
+                String dec_link = decryptMegaPasswordLink(link, new String(pass_field.getPassword()));
+
+                if (dec_link != null) {
+                    return dec_link;
+                }
+
+                JOptionPane.showMessageDialog(this, LabelTranslatorSingleton.getInstance().translate("WRONG PASSWORD"), "Error", JOptionPane.ERROR_MESSAGE);
+
+            } catch (Exception ex) {
+
+                LOG.log(SEVERE, ex.getMessage());
+
+                JOptionPane.showMessageDialog(this, ex.getMessage(), "Error", JOptionPane.ERROR_MESSAGE);
+
+                return null;
+            }
+        }
+    }
+
     private void _file_drop_notify(List<File> files) {
 
         final MainPanelView tthis = this;
@@ -1085,6 +1121,17 @@ public final class MainPanelView extends javax.swing.JFrame {
                     }
                 });
 
+                Set<String> password_links = new HashSet(findAllRegex("https?://mega(?:\\.co)?\\.nz/#P![A-Za-z0-9_-]+", link_data, 0));
+
+                password_links.forEach((link) -> {
+
+                    String dec_link = _decryptMegaPasswordLink(link);
+
+                    if (dec_link != null) {
+                        urls.add(dec_link);
+                    }
+                });
+
                 Set<String> elc = new HashSet(findAllRegex("mega://elc[^\r\n]+", link_data, 0));
 
                 elc.forEach((link) -> {
@@ -10,6 +10,7 @@
 package com.tonikelope.megabasterd;
 
 import com.fasterxml.jackson.core.JsonParser;
+import com.fasterxml.jackson.core.JsonProcessingException;
 import com.fasterxml.jackson.databind.ObjectMapper;
 import static com.tonikelope.megabasterd.CryptTools.*;
 import static com.tonikelope.megabasterd.MiscTools.*;
@@ -110,6 +111,11 @@ public class MegaAPI implements Serializable {
         _seqno = randomno.nextLong() & 0xffffffffL;
     }
 
+    //Every request gets its own id (retries inside RAW_REQUEST reuse it, as MEGA expects), even if several threads share this MegaAPI
+    private synchronized long _nextSeqno() {
+        return _seqno++;
+    }
+
     public int getAccount_version() {
         return _account_version;
     }
@@ -164,7 +170,7 @@ public class MegaAPI implements Serializable {
             request = "[{\"a\":\"us\",\"user\":\"" + _email + "\",\"uh\":\"" + _user_hash + "\"}]";
         }
 
-        URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno));
+        URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()));
 
         String res = RAW_REQUEST(request, url_api);
 
@@ -200,7 +206,7 @@ public class MegaAPI implements Serializable {
 
         String request = "[{\"a\":\"us0\",\"user\":\"" + _email + "\"}]";
 
-        URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno));
+        URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()));
 
         String res = RAW_REQUEST(request, url_api);
 
@@ -218,7 +224,7 @@ public class MegaAPI implements Serializable {
 
         String request = "[{\"a\":\"mfag\",\"e\":\"" + email + "\"}]";
 
-        URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno));
+        URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()));
 
         String res = RAW_REQUEST(request, url_api);
 
@@ -288,7 +294,7 @@ public class MegaAPI implements Serializable {
 
             URL url_api;
 
-            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String res = RAW_REQUEST(request, url_api);
 
@@ -296,25 +302,9 @@ public class MegaAPI implements Serializable {
 
             HashMap[] res_map = objectMapper.readValue(res, HashMap[].class);
 
-            quota = new Long[2];
-
-            if (res_map[0].get("cstrg") instanceof Integer) {
-
-                quota[0] = ((Number) res_map[0].get("cstrg")).longValue();
-
-            } else if (res_map[0].get("cstrg") instanceof Long) {
-
-                quota[0] = (Long) res_map[0].get("cstrg");
-            }
+            HashMap quota_map = _getResponseMap(res_map, 0);
 
-            if (res_map[0].get("mstrg") instanceof Integer) {
-
-                quota[1] = ((Number) res_map[0].get("mstrg")).longValue();
-
-            } else if (res_map[0].get("mstrg") instanceof Long) {
-
-                quota[1] = (Long) res_map[0].get("mstrg");
-            }
+            quota = new Long[]{_getResponseLong(quota_map, "cstrg"), _getResponseLong(quota_map, "mstrg")};
 
         } catch (Exception ex) {
 
@@ -332,7 +322,7 @@ public class MegaAPI implements Serializable {
 
         try {
 
-            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String res = RAW_REQUEST(request, url_api);
 
@@ -534,8 +524,6 @@ public class MegaAPI implements Serializable {
 
         } while (http_error == 500 || empty_response || mega_error != 0 || (http_error == 509 && MainPanel.isUse_smart_proxy() && !MainPanel.isUse_proxy()));
 
-        _seqno++;
-
         return response;
 
     }
@@ -553,12 +541,12 @@ public class MegaAPI implements Serializable {
 
             request = "[{\"a\":\"g\", \"g\":\"1\", \"n\":\"" + file_id + "\"}]";
 
-            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : "") + "&n=" + folder_id);
+            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : "") + "&n=" + folder_id);
 
         } else {
 
             request = "[{\"a\":\"g\", \"g\":\"1\", \"p\":\"" + file_id + "\"}]";
-            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
         }
 
         String data = RAW_REQUEST(request, url_api);
@@ -567,13 +555,7 @@ public class MegaAPI implements Serializable {
 
         HashMap[] res_map = objectMapper.readValue(data, HashMap[].class);
 
-        String download_url = (String) res_map[0].get("g");
-
-        if (download_url == null || "".equals(download_url)) {
-            throw new MegaAPIException(-101);
-        }
-
-        return download_url;
+        return _getResponseString(_getResponseMap(res_map, 0), "g");
     }
 
     public String[] getMegaFileMetadata(String link) throws MegaAPIException, MalformedURLException, IOException {
@@ -582,6 +564,15 @@ public class MegaAPI implements Serializable {
 
         String file_key = findFirstRegex("#.*?![^!]+!([^!#]+)", link, 1);
 
+        int key_length = getMEGAFileKeyLength(file_key);
+
+        if (key_length != MEGA_FILE_KEY_LENGTH) {
+
+            LOG.log(Level.WARNING, "{0} Bad file key for {1} (decoded length: {2})", new Object[]{Thread.currentThread().getName(), file_id, key_length});
+
+            throw new MegaAPIException(-14);
+        }
+
         String request;
 
         URL url_api;
@@ -589,15 +580,15 @@ public class MegaAPI implements Serializable {
         if (findFirstRegex("#N!", link, 0) != null) {
             String folder_id = findFirstRegex("###n=(.+)$", link, 1);
 
-            request = "[{\"a\":\"g\", \"g\":\"1\", \"n\":\"" + file_id + "\"}]";
+            request = "[{\"a\":\"g\", \"n\":\"" + file_id + "\"}]";
 
-            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : "") + "&n=" + folder_id);
+            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : "") + "&n=" + folder_id);
 
         } else {
 
             request = "[{\"a\":\"g\", \"p\":\"" + file_id + "\"}]";
 
-            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
         }
 
         String data = RAW_REQUEST(request, url_api);
@@ -606,9 +597,11 @@ public class MegaAPI implements Serializable {
 
         HashMap[] res_map = objectMapper.readValue(data, HashMap[].class);
 
-        String fsize = String.valueOf(res_map[0].get("s"));
+        HashMap file_map = _getResponseMap(res_map, 0);
+
+        String fsize = String.valueOf(_getResponseLong(file_map, "s"));
 
-        String at = (String) res_map[0].get("at");
+        String at = _getResponseString(file_map, "at");
 
         String[] file_data = null;
 
@@ -616,9 +609,7 @@ public class MegaAPI implements Serializable {
 
         if (att_map != null) {
 
-            String fname = cleanFilename((String) att_map.get("n"));
-
-            file_data = new String[]{fname, fsize, file_key};
+            file_data = new String[]{_getNodeName(att_map, file_id), fsize, file_key};
 
         } else {
 
@@ -628,6 +619,21 @@ public class MegaAPI implements Serializable {
         return file_data;
     }
 
+    //Empty, "." or dots/whitespace only names would resolve to the download folder itself, so we use the node id instead
+    private String _getNodeName(HashMap attr, String node_id) {
+
+        String name = (attr != null && attr.get("n") != null) ? String.valueOf(attr.get("n")) : "";
+
+        if (name.matches("[.\\s]*") || cleanFilename(name).isEmpty()) {
+
+            LOG.log(Level.WARNING, "{0} Node {1} has no usable name attribute, using its id as filename", new Object[]{Thread.currentThread().getName(), node_id});
+
+            return node_id;
+        }
+
+        return cleanFilename(name);
+    }
+
     private byte[] _encThumbAttr(byte[] attr_byte, byte[] key) {
 
         try {
@@ -641,6 +647,16 @@ public class MegaAPI implements Serializable {
         return null;
     }
 
+    //Names must be JSON escaped (quotes, backslashes, control chars) or MEGA clients will not be able to parse the attribute
+    private String _genNameAttr(String name) throws JsonProcessingException {
+
+        HashMap<String, Object> attr = new HashMap<>();
+
+        attr.put("n", name);
+
+        return new ObjectMapper().writeValueAsString(attr);
+    }
+
     private byte[] _encAttr(String attr, byte[] key) {
 
         byte[] ret = null;
@@ -690,6 +706,46 @@ public class MegaAPI implements Serializable {
         return res_map;
     }
 
+    private HashMap _getResponseMap(HashMap[] res_map, int index) throws MegaAPIException {
+
+        if (res_map == null || index >= res_map.length || res_map[index] == null) {
+
+            LOG.log(Level.WARNING, "{0} Malformed MEGA API response (missing element {1})", new Object[]{Thread.currentThread().getName(), index});
+
+            throw new MegaAPIException(-101);
+        }
+
+        return res_map[index];
+    }
+
+    private String _getResponseString(HashMap map, String key) throws MegaAPIException {
+
+        Object value = map.get(key);
+
+        if (!(value instanceof String) || "".equals(value)) {
+
+            LOG.log(Level.WARNING, "{0} Malformed MEGA API response (bad \"{1}\" value: {2})", new Object[]{Thread.currentThread().getName(), key, value});
+
+            throw new MegaAPIException(-101);
+        }
+
+        return (String) value;
+    }
+
+    private Long _getResponseLong(HashMap map, String key) throws MegaAPIException {
+
+        Object value = map.get(key);
+
+        if (!(value instanceof Number)) {
+
+            LOG.log(Level.WARNING, "{0} Malformed MEGA API response (bad \"{1}\" value: {2})", new Object[]{Thread.currentThread().getName(), key, value});
+
+            throw new MegaAPIException(-101);
+        }
+
+        return ((Number) value).longValue();
+    }
+
     public String initUploadFile(String filename) throws MegaAPIException {
 
         String ul_url = null;
@@ -700,7 +756,7 @@ public class MegaAPI implements Serializable {
 
             String request = "[{\"a\":\"u\", \"s\":" + String.valueOf(f.length()) + "}]";
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String res = RAW_REQUEST(request, url_api);
 
@@ -743,7 +799,7 @@ public class MegaAPI implements Serializable {
 
             String request = "[{\"a\":\"ufa\", \"s\":" + String.valueOf(file_bytes[0].length) + ", \"ssl\":1}, {\"a\":\"ufa\", \"s\":" + String.valueOf(file_bytes[1].length) + ", \"ssl\":1}]";
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String res = RAW_REQUEST(request, url_api);
 
@@ -801,7 +857,7 @@ public class MegaAPI implements Serializable {
 
             request = "[{\"a\":\"pfa\", \"fa\":\"0*" + hash[0] + "/1*" + hash[1] + "\", \"n\":\"" + node_handle + "\"}]";
 
-            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             res = RAW_REQUEST(request, url_api);
 
@@ -828,9 +884,9 @@ public class MegaAPI implements Serializable {
 
         try {
 
-            byte[] enc_att = _encAttr("{\"n\":\"" + fbasename + "\"}", i32a2bin(Arrays.copyOfRange(ul_key, 0, 4)));
+            byte[] enc_att = _encAttr(_genNameAttr(fbasename), i32a2bin(Arrays.copyOfRange(ul_key, 0, 4)));
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String request = "[{\"a\":\"p\", \"t\":\"" + mega_parent + "\", \"n\":[{\"h\":\"" + completion_handle + "\", \"t\":0, \"a\":\"" + Bin2UrlBASE64(enc_att) + "\", \"k\":\"" + Bin2UrlBASE64(encryptKey(i32a2bin(fkey), master_key)) + "\"}], \"i\":\"" + _req_id + "\", \"cr\" : [ [\"" + root_node + "\"] , [\"" + completion_handle + "\"] , [0,0, \"" + Bin2UrlBASE64(encryptKey(i32a2bin(fkey), share_key)) + "\"]]}]";
 
@@ -883,11 +939,11 @@ public class MegaAPI implements Serializable {
 
         try {
 
-            byte[] enc_att = _encAttr("{\"n\":\"" + name + "\"}", node_key);
+            byte[] enc_att = _encAttr(_genNameAttr(name), node_key);
 
             byte[] enc_node_key = encryptKey(node_key, master_key);
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String request = "[{\"a\":\"p\", \"t\":\"" + parent_node + "\", \"n\":[{\"h\":\"xxxxxxxx\",\"t\":1,\"a\":\"" + Bin2UrlBASE64(enc_att) + "\",\"k\":\"" + Bin2UrlBASE64(enc_node_key) + "\"}],\"i\":\"" + _req_id + "\"}]";
 
@@ -911,13 +967,13 @@ public class MegaAPI implements Serializable {
 
         try {
 
-            byte[] enc_att = _encAttr("{\"n\":\"" + name + "\"}", node_key);
+            byte[] enc_att = _encAttr(_genNameAttr(name), node_key);
 
             byte[] enc_node_key = encryptKey(node_key, master_key);
 
             byte[] enc_node_key_s = encryptKey(node_key, share_key);
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String request = "[{\"a\":\"p\", \"t\":\"" + parent_node + "\", \"n\":[{\"h\":\"xxxxxxxx\",\"t\":1,\"a\":\"" + Bin2UrlBASE64(enc_att) + "\",\"k\":\"" + Bin2UrlBASE64(enc_node_key) + "\"}],\"i\":\"" + _req_id + "\", \"cr\" : [ [\"" + root_node + "\"] , [\"xxxxxxxx\"] , [0,0, \"" + Bin2UrlBASE64(enc_node_key_s) + "\"]]}]";
 
@@ -947,7 +1003,7 @@ public class MegaAPI implements Serializable {
 
             String request = "[{\"a\":\"l\", \"n\":\"" + node + "\"}]";
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String res = RAW_REQUEST(request, url_api);
 
@@ -978,7 +1034,7 @@ public class MegaAPI implements Serializable {
 
             String request = "[{\"a\":\"l\", \"n\":\"" + node + "\", \"i\":\"" + _req_id + "\"}]";
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             String res = RAW_REQUEST(request, url_api);
 
@@ -1025,7 +1081,7 @@ public class MegaAPI implements Serializable {
             //OJO
             String request = "[{\"a\":\"s2\",\"n\":\"" + node + "\",\"s\":[{\"u\":\"EXP\",\"r\":0}],\"i\":\"" + _req_id + "\",\"ok\":\"AAAAAAAAAAAAAAAAAAAAAA\",\"ha\":\"AAAAAAAAAAAAAAAAAAAAAA\",\"cr\":[[\"" + node + "\"],[\"" + node + "\"],[0,0,\"" + enc_nk + "\"]]}]";
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + (_sid != null ? "&sid=" + _sid : ""));
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + (_sid != null ? "&sid=" + _sid : ""));
 
             return RAW_REQUEST(request, url_api);
 
@@ -1097,7 +1153,7 @@ public class MegaAPI implements Serializable {
 
             String request = "[{\"a\":\"f\", \"c\":\"1\", \"r\":\"1\", \"ca\":\"1\"}]";
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + "&n=" + folder_id);
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + "&n=" + folder_id);
 
             res = RAW_REQUEST(request, url_api);
 
@@ -1142,15 +1198,15 @@ public class MegaAPI implements Serializable {
 
                 HashMap<String, Object> node = (HashMap<String, Object>) o;
 
-                String[] node_k = ((String) node.get("k")).split(":");
+                Object[] dec_node = _decryptFolderNode(node, folder_key);
 
-                if (node_k.length == 2 && node_k[0] != "" && node_k[1] != "") {
+                if (dec_node != null) {
 
                     try {
 
-                        String dec_node_k = Bin2UrlBASE64(decryptKey(UrlBASE642Bin(node_k[1]), _urlBase64KeyDecode(folder_key)));
+                        String dec_node_k = (String) dec_node[0];
 
-                        HashMap at = _decAttr((String) node.get("a"), _urlBase64KeyDecode(dec_node_k));
+                        HashMap at = (HashMap) dec_node[1];
 
                         HashMap<String, Object> the_node = new HashMap<>();
 
@@ -1176,7 +1232,7 @@ public class MegaAPI implements Serializable {
                             the_node.put("size", 0L);
                         }
 
-                        the_node.put("name", at.get("n"));
+                        the_node.put("name", _getNodeName(at, (String) node.get("h")));
 
                         the_node.put("h", node.get("h"));
 
@@ -1265,7 +1321,7 @@ public class MegaAPI implements Serializable {
 
             String request = "[{\"a\":\"f\", \"c\":\"1\", \"r\":\"1\", \"ca\":\"1\"}]";
 
-            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_seqno) + "&n=" + folder_id);
+            URL url_api = new URL(API_URL + "/cs?id=" + String.valueOf(_nextSeqno()) + "&n=" + folder_id);
 
             res = RAW_REQUEST(request, url_api);
 
@@ -1286,13 +1342,13 @@ public class MegaAPI implements Serializable {
 
                 HashMap<String, Object> node = (HashMap<String, Object>) o;
 
-                String[] node_k = ((String) node.get("k")).split(":");
+                Object[] dec_node = _decryptFolderNode(node, folder_key);
 
-                if (node_k.length == 2 && node_k[0] != "" && node_k[1] != "") {
+                if (dec_node != null) {
 
                     try {
 
-                        String dec_node_k = Bin2UrlBASE64(decryptKey(UrlBASE642Bin(node_k[1]), _urlBase64KeyDecode(folder_key)));
+                        String dec_node_k = (String) dec_node[0];
 
                         if (file_ids.contains((String) node.get("h"))) {
 
@@ -1320,6 +1376,61 @@ public class MegaAPI implements Serializable {
 
     }
 
+    //Nodes inside nested shares carry one handle:key pair per share (h1:k1/h2:k2). We take the first one that decrypts the node attributes.
+    //Returns {node key, attributes map} or null if none of the pairs is valid
+    private Object[] _decryptFolderNode(HashMap<String, Object> node, String folder_key) {
+
+        for (String share_node_k : ((String) node.get("k")).split("/")) {
+
+            String[] node_k = share_node_k.split(":");
+
+            if (node_k.length == 2 && !node_k[0].isEmpty() && !node_k[1].isEmpty()) {
+
+                try {
+
+                    String dec_node_k = Bin2UrlBASE64(decryptKey(UrlBASE642Bin(node_k[1]), _urlBase64KeyDecode(folder_key)));
+
+                    HashMap at = _decCheckedAttr((String) node.get("a"), _urlBase64KeyDecode(dec_node_k));
+
+                    if (at != null) {
+                        return new Object[]{dec_node_k, at};
+                    }
+
+                } catch (Exception ex) {
+                }
+            }
+        }
+
+        return null;
+    }
+
+    //Like _decAttr but quiet and it only accepts attributes with the "MEGA" prefix (i.e. decrypted with the right key)
+    private HashMap _decCheckedAttr(String encAttr, byte[] key) {
+
+        try {
+
+            byte[] decrypted_at = aes_cbc_decrypt_nopadding(UrlBASE642Bin(encAttr), key, AES_ZERO_IV);
+
+            String att = new String(decrypted_at, "UTF-8").replaceAll("\0+$", "");
+
+            if (!att.startsWith("MEGA")) {
+                return null;
+            }
+
+            ObjectMapper objectMapper = new ObjectMapper();
+
+            objectMapper.configure(JsonParser.Feature.ALLOW_SINGLE_QUOTES, true);
+
+            objectMapper.configure(JsonParser.Feature.ALLOW_BACKSLASH_ESCAPING_ANY_CHARACTER, true);
+
+            return objectMapper.readValue(att.substring(4), HashMap.class);
+
+        } catch (Exception ex) {
+
+            return null;
+        }
+    }
+
     private byte[] _urlBase64KeyDecode(String key) {
 
         try {
@@ -325,7 +325,8 @@ public class MiscTools {
     public static int[] bin2i32a(byte[] bin) {
         int l = (int) (4 * Math.ceil((double) bin.length / 4));
 
-        IntBuffer intBuf = ByteBuffer.wrap(bin, 0, l).order(ByteOrder.BIG_ENDIAN).asIntBuffer();
+        //Like MEGA's base64_to_a32, lengths not multiple of 4 are zero padded at the end
+        IntBuffer intBuf = ByteBuffer.wrap(l > bin.length ? Arrays.copyOf(bin, l) : bin, 0, l).order(ByteOrder.BIG_ENDIAN).asIntBuffer();
 
         int[] array = new int[intBuf.remaining()];
 
@@ -1080,6 +1081,7 @@ public class MiscTools {
             String clean_data = MiscTools.newMegaLinks2Legacy(url_decoded);
             links.addAll(findAllRegex("(?:https?|mega)://[^\r\n]+(#[^\r\n!]*?)?![^\r\n!]+![^\\?\r\n/]+", clean_data, 0));
             links.addAll(findAllRegex("mega://e(n|l)c[^\r\n]+", clean_data, 0));
+            links.addAll(findAllRegex("https?://mega(?:\\.co)?\\.nz/#P![A-Za-z0-9_-]+", clean_data, 0));
             res = links.stream().map((s) -> s + "\n").reduce(res, String::concat);
         }
 
@@ -1687,9 +1689,10 @@ public class MiscTools {
         return data.replaceAll("(?:https://)?mega(?:\\.co)?\\.nz/folder/([^#]+)#([^\r\n]+)", "https://mega.nz/#F!$1!$2").replaceAll("(?:https://)?mega(?:\\.co)?\\.nz/file/([^#]+)#([^\r\n]+)", "https://mega.nz/#!$1!$2");
     }
 
+    //http://, www.mega.nz and mega.co.nz spellings all end up as https://mega.nz so the same link is not queued twice
     public static String addHTTPSToMegaLinks(String data) {
 
-        return data.replaceAll("(?<!https?://)mega(?:\\.co)?\\.nz", "https://mega.nz");
+        return data.replaceAll("(?<![\\w.-])(?:https?://)?(?:www\\.)?mega(?:\\.co)?\\.nz", "https://mega.nz");
     }
 
     public static String addBackSlashToLinks(String data) {
@@ -26,6 +26,7 @@ public class SpeedMeter implements Runnable {
 
     public static final int SLEEP = 3000;
     public static final int CHUNK_SPEED_QUEUE_MAX_SIZE = 20;
+    public static final double SPEED_EMA_ALPHA = 0.3;
     private static final Logger LOG = Logger.getLogger(SpeedMeter.class.getName());
     private final JLabel _speed_label;
     private final JLabel _rem_label;
@@ -55,6 +56,7 @@ public class SpeedMeter implements Runnable {
 
         properties.put("last_progress", transference.getProgress());
         properties.put("no_data_count", 0);
+        properties.put("ema_speed", 0L);
 
         _transferences.put(transference, properties);
 
@@ -97,10 +99,14 @@ public class SpeedMeter implements Runnable {
 
         int no_data_count = (int) properties.get("no_data_count");
 
+        long ema_speed = (long) properties.get("ema_speed");
+
         if (transference.isPaused()) {
 
             sp = 0;
 
+            ema_speed = 0;
+
         } else if (progress > last_progress) {
 
             double sleep_time = ((double) SLEEP * (no_data_count + 1)) / 1000;
@@ -109,6 +115,11 @@ public class SpeedMeter implements Runnable {
 
             sp = last_progress > 0 ? Math.round(current_speed) : 0;
 
+            //Exponential moving average to avoid a jumpy speed label (raw speed is still used for global stats)
+            if (sp > 0) {
+                ema_speed = ema_speed > 0 ? Math.round(SPEED_EMA_ALPHA * sp + (1 - SPEED_EMA_ALPHA) * ema_speed) : sp;
+            }
+
             last_progress = progress;
 
             no_data_count = 0;
@@ -117,12 +128,16 @@ public class SpeedMeter implements Runnable {
 
             sp = -1;
 
+            ema_speed = 0;
+
             no_data_count++;
 
         } else {
 
             sp = 0;
 
+            ema_speed = 0;
+
             no_data_count++;
         }
 
@@ -130,6 +145,8 @@ public class SpeedMeter implements Runnable {
 
         properties.put("no_data_count", no_data_count);
 
+        properties.put("ema_speed", ema_speed);
+
         _transferences.put(transference, properties);
 
         return sp;
@@ -165,7 +182,7 @@ public class SpeedMeter implements Runnable {
 
                         if (trans_sp > 0) {
 
-                            trans_info.getKey().getView().updateSpeed(formatBytes(trans_sp) + "/s", true);
+                            trans_info.getKey().getView().updateSpeed(formatBytes((long) trans_info.getValue().get("ema_speed")) + "/s", true);
 
                         } else {
 